@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
 	"time"
 
 	"github.com/autonomic-ai/aws-okta/lib/client/types"
@@ -23,8 +22,32 @@ var (
 	errNoDeviceFound = fmt.Errorf("no U2F devices found. device might not be plugged in")
 )
 
+// DefaultU2fTimeout is how long ChallengeU2f waits for a touch when
+// FIDODevice.Timeout is left unset.
+const DefaultU2fTimeout = 25 * time.Second
+
 // FIDODevice is implementation of MFADevice for SMS
 type FIDODevice struct {
+	// Prompter receives touch/code prompts instead of them being written
+	// directly to stderr. Defaults to StderrPrompter when nil.
+	Prompter MFAPrompter
+	// Timeout bounds how long ChallengeU2f waits for a device to respond.
+	// Defaults to DefaultU2fTimeout when zero.
+	Timeout time.Duration
+}
+
+func (d *FIDODevice) prompter() MFAPrompter {
+	if d.Prompter == nil {
+		return StderrPrompter{}
+	}
+	return d.Prompter
+}
+
+func (d *FIDODevice) timeout() time.Duration {
+	if d.Timeout == 0 {
+		return DefaultU2fTimeout
+	}
+	return d.Timeout
 }
 
 // Supported will check if the mfa config can be used by this device
@@ -38,16 +61,28 @@ func (d *FIDODevice) Supported(factor Config) error {
 // Verify is called to get generate the payload that will be sent to Okta.
 //   We will call this twice, once to tell Okta to send the code then
 //   Once to prompt the user using `CodeSupplier` for the code.
+//
+// Okta's MFA_CHALLENGE response is scoped to the single factor that was
+// challenged (authResp.Embedded.Factor) - it does not hand back nonces for
+// any other enrolled FIDO factor, so we can only ever challenge the one
+// credential Okta gave us here. What ChallengeU2f can do on its own is poll
+// every *device* currently plugged in against that one credential, so the
+// user can tap whichever key happens to be enrolled for it. Actually
+// challenging multiple enrolled *credentials* (e.g. a primary + backup key)
+// would additionally require the caller to issue a separate factor-scoped
+// challenge request per enrolled FIDO factor before calling Verify; that
+// round trip doesn't exist anywhere in this package or tree today.
 func (d *FIDODevice) Verify(authResp types.OktaUserAuthn) (string, []byte, error) {
 	var code string
 
 	if authResp.Status == "MFA_CHALLENGE" {
 		f := authResp.Embedded.Factor
-		fidoClient, err := NewFidoClient(f.Embedded.Challenge.Nonce,
-			f.Profile.AppId,
-			f.Profile.Version,
-			f.Profile.CredentialId,
-			authResp.StateToken)
+		credentials := []fidoCredential{{
+			ChallengeNonce: f.Embedded.Challenge.Nonce,
+			KeyHandle:      f.Profile.CredentialId,
+		}}
+
+		fidoClient, err := NewFidoClient(credentials, f.Profile.AppId, f.Profile.Version, authResp.StateToken, d.prompter(), d.timeout())
 		if err != nil {
 			return "", []byte{}, err
 		}
@@ -74,13 +109,21 @@ func (d *FIDODevice) Verify(authResp types.OktaUserAuthn) (string, []byte, error
 	return "verify", payload, err
 }
 
-type FidoClient struct {
+// fidoCredential pairs up the challenge nonce and key handle for a single
+// enrolled FIDO factor, since each one is its own independent U2F credential.
+type fidoCredential struct {
 	ChallengeNonce string
-	AppId          string
-	Version        string
-	Device         u2fhost.Device
 	KeyHandle      string
-	StateToken     string
+}
+
+type FidoClient struct {
+	Credentials []fidoCredential
+	AppId       string
+	Version     string
+	Devices     []u2fhost.Device
+	StateToken  string
+	Prompter    MFAPrompter
+	Timeout     time.Duration
 }
 
 type SignedAssertion struct {
@@ -89,13 +132,20 @@ type SignedAssertion struct {
 	SignatureData string `json:"signatureData"`
 }
 
-func NewFidoClient(challengeNonce, appId, version, keyHandle, stateToken string) (FidoClient, error) {
-	var device u2fhost.Device
+func NewFidoClient(credentials []fidoCredential, appId, version, stateToken string, prompter MFAPrompter, timeout time.Duration) (FidoClient, error) {
+	var devices []u2fhost.Device
 	var err error
 
+	if prompter == nil {
+		prompter = StderrPrompter{}
+	}
+	if timeout == 0 {
+		timeout = DefaultU2fTimeout
+	}
+
 	retryCount := 0
 	for retryCount < MaxOpenRetries {
-		device, err = findDevice()
+		devices, err = findDevices()
 		if err != nil {
 			if err == errNoDeviceFound {
 				return FidoClient{}, err
@@ -107,74 +157,141 @@ func NewFidoClient(challengeNonce, appId, version, keyHandle, stateToken string)
 		}
 
 		return FidoClient{
-			Device:         device,
-			ChallengeNonce: challengeNonce,
-			AppId:          appId,
-			Version:        version,
-			KeyHandle:      keyHandle,
-			StateToken:     stateToken,
+			Devices:     devices,
+			Credentials: credentials,
+			AppId:       appId,
+			Version:     version,
+			StateToken:  stateToken,
+			Prompter:    prompter,
+			Timeout:     timeout,
 		}, nil
 	}
 
 	return FidoClient{}, fmt.Errorf("failed to create client: %s. exceeded max retries of %d", err, MaxOpenRetries)
 }
 
+// devicePoll tracks, for one opened device, which of the enrolled
+// credentials it has not yet been ruled out for.
+type devicePoll struct {
+	device      u2fhost.Device
+	credentials []fidoCredential
+}
+
+// ChallengeU2f broadcasts the authentication request for every enrolled
+// credential to every device that was opened by NewFidoClient, and returns
+// as soon as any (device, credential) pair produces a signed assertion,
+// so the user can tap whichever plugged-in key holds one of d.Credentials.
+// FIDODevice.Verify passes only the single credential Okta challenged.
+// A device/credential pair that immediately reports the key handle as not
+// registered is dropped instead of aborting the whole flow; a device is
+// dropped entirely once none of the credentials match it, or as soon as it
+// returns an unrecognized error. Once every device has been dropped an
+// error is returned straight away; otherwise the call fails with a timeout
+// error when the deadline elapses.
 func (d *FidoClient) ChallengeU2f() (*SignedAssertion, error) {
 
-	if d.Device == nil {
+	if len(d.Devices) == 0 {
 		return nil, errors.New("no device found")
 	}
-	request := &u2fhost.AuthenticateRequest{
-		Challenge: d.ChallengeNonce,
-		// the appid is the only facet.
-		Facet:     d.AppId,
-		AppId:     d.AppId,
-		KeyHandle: d.KeyHandle,
+	if len(d.Credentials) == 0 {
+		return nil, errors.New("no credentials to challenge")
 	}
-	// do the change
+
+	prompter := d.Prompter
+	if prompter == nil {
+		prompter = StderrPrompter{}
+	}
+	challengeTimeout := d.Timeout
+	if challengeTimeout == 0 {
+		challengeTimeout = DefaultU2fTimeout
+	}
+	factor := Config{FactorType: "u2f", Provider: "FIDO"}
+
 	prompted := false
-	timeout := time.After(time.Second * 25)
+	timeout := time.After(challengeTimeout)
 	interval := time.NewTicker(time.Millisecond * 250)
-	var responsePayload *SignedAssertion
 
-	defer func() {
-		d.Device.Close()
-	}()
+	polls := make([]devicePoll, len(d.Devices))
+	for i, device := range d.Devices {
+		polls[i] = devicePoll{device: device, credentials: d.Credentials}
+	}
+
+	closeAll := func(remaining []devicePoll) {
+		for _, p := range remaining {
+			p.device.Close()
+		}
+	}
+
 	defer interval.Stop()
 	for {
 		select {
 		case <-timeout:
-			return nil, errors.New("failed to get authentication response after 25 seconds")
+			closeAll(polls)
+			return nil, fmt.Errorf("failed to get authentication response after %s", challengeTimeout)
 		case <-interval.C:
-			response, err := d.Device.Authenticate(request)
-			if err == nil {
-				responsePayload = &SignedAssertion{
-					StateToken:    d.StateToken,
-					ClientData:    response.ClientData,
-					SignatureData: response.SignatureData,
+			var stillPolling []devicePoll
+			for i, p := range polls {
+				var remainingCreds []fidoCredential
+			credLoop:
+				for _, cred := range p.credentials {
+					request := &u2fhost.AuthenticateRequest{
+						Challenge: cred.ChallengeNonce,
+						// the appid is the only facet.
+						Facet:     d.AppId,
+						AppId:     d.AppId,
+						KeyHandle: cred.KeyHandle,
+					}
+					response, err := p.device.Authenticate(request)
+					if err == nil {
+						responsePayload := &SignedAssertion{
+							StateToken:    d.StateToken,
+							ClientData:    response.ClientData,
+							SignatureData: response.SignatureData,
+						}
+						prompter.TouchAccepted(factor)
+						p.device.Close()
+						closeAll(stillPolling)
+						closeAll(polls[i+1:])
+						return responsePayload, nil
+					}
+
+					switch t := err.(type) {
+					case *u2fhost.TestOfUserPresenceRequiredError:
+						if !prompted {
+							prompter.TouchRequested(factor)
+							prompted = true
+						}
+						remainingCreds = append(remainingCreds, cred)
+					case *u2fhost.BadKeyHandleError:
+						log.Debugf("device did not recognize key handle %s, dropping credential: %s", cred.KeyHandle, t)
+					default:
+						// This device is misbehaving in some way we don't
+						// recognize. Drop just this device so a flaky
+						// second key can't take down authentication on a
+						// working one; the rest of the poll continues.
+						log.Debugf("dropping device after unexpected error: %s", t)
+						remainingCreds = nil
+						break credLoop
+					}
 				}
-				fmt.Fprintf(os.Stderr, "  ==> Touch accepted. Proceeding with authentication\n")
-				return responsePayload, nil
-			}
 
-			switch t := err.(type) {
-			case *u2fhost.TestOfUserPresenceRequiredError:
-				if !prompted {
-					fmt.Fprintf(os.Stderr, "\nTouch the flashing U2F device to authenticate...\n")
-					prompted = true
+				if len(remainingCreds) > 0 {
+					stillPolling = append(stillPolling, devicePoll{device: p.device, credentials: remainingCreds})
+				} else {
+					p.device.Close()
 				}
-			default:
-				log.Debug("Got ErrType: ", t)
-				return responsePayload, err
+			}
+
+			polls = stillPolling
+			if len(polls) == 0 {
+				return nil, errors.New("no remaining U2F devices recognized any enrolled credential")
 			}
 		}
 	}
-
-	return responsePayload, nil
 }
 
-func findDevice() (u2fhost.Device, error) {
-	var err error
+func findDevices() ([]u2fhost.Device, error) {
+	var opened []u2fhost.Device
 
 	allDevices := u2fhost.Devices()
 	if len(allDevices) == 0 {
@@ -182,7 +299,7 @@ func findDevice() (u2fhost.Device, error) {
 	}
 
 	for i, device := range allDevices {
-		err = device.Open()
+		err := device.Open()
 		if err != nil {
 			log.Debugf("failed to open device: %s", err)
 			device.Close()
@@ -190,8 +307,12 @@ func findDevice() (u2fhost.Device, error) {
 			continue
 		}
 
-		return allDevices[i], nil
+		opened = append(opened, allDevices[i])
+	}
+
+	if len(opened) == 0 {
+		return nil, errNoDeviceFound
 	}
 
-	return nil, fmt.Errorf("failed to open fido U2F device: %s", err)
+	return opened, nil
 }
@@ -0,0 +1,45 @@
+package mfa
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// MFAPrompter decouples MFA devices from stderr/stdin so aws-okta can be
+// embedded in GUIs, daemons, and test harnesses that need to surface these
+// prompts through their own UI instead of a terminal.
+type MFAPrompter interface {
+	// TouchRequested is called when a device is waiting for the user to
+	// touch it to approve the authentication.
+	TouchRequested(factor Config)
+	// TouchAccepted is called once a device reports a successful touch.
+	TouchAccepted(factor Config)
+	// CodeRequested is called when the user needs to type in a one-time
+	// code, e.g. for TOTP or SMS factors.
+	CodeRequested(factor Config) (string, error)
+}
+
+// StderrPrompter is the default MFAPrompter and preserves aws-okta's
+// existing CLI behavior of writing prompts to stderr and reading codes from
+// stdin.
+type StderrPrompter struct{}
+
+func (StderrPrompter) TouchRequested(factor Config) {
+	fmt.Fprintf(os.Stderr, "\nTouch the flashing U2F device to authenticate...\n")
+}
+
+func (StderrPrompter) TouchAccepted(factor Config) {
+	fmt.Fprintf(os.Stderr, "  ==> Touch accepted. Proceeding with authentication\n")
+}
+
+func (StderrPrompter) CodeRequested(factor Config) (string, error) {
+	fmt.Fprintf(os.Stderr, "Enter MFA code for %s: ", factor.FactorType)
+	reader := bufio.NewReader(os.Stdin)
+	text, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(text), nil
+}
@@ -0,0 +1,58 @@
+package mfa
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestDecodeU2FSignature(t *testing.T) {
+	flagsAndCounter := []byte{0x01, 0x00, 0x00, 0x00, 0x2a}
+	signature := []byte{0xde, 0xad, 0xbe, 0xef}
+	raw := append(append([]byte{}, flagsAndCounter...), signature...)
+
+	cases := []struct {
+		name    string
+		encoded string
+		wantErr bool
+	}{
+		{
+			name:    "raw url encoding",
+			encoded: base64.RawURLEncoding.EncodeToString(raw),
+		},
+		{
+			name:    "standard encoding",
+			encoded: base64.StdEncoding.EncodeToString(raw),
+		},
+		{
+			name:    "too short",
+			encoded: base64.RawURLEncoding.EncodeToString([]byte{0x01, 0x00, 0x00}),
+			wantErr: true,
+		},
+		{
+			name:    "not base64",
+			encoded: "!!!not-base64!!!",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			gotFlagsAndCounter, gotSignature, err := decodeU2FSignature(tc.encoded)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(gotFlagsAndCounter) != string(flagsAndCounter) {
+				t.Errorf("flagsAndCounter = %x, want %x", gotFlagsAndCounter, flagsAndCounter)
+			}
+			if string(gotSignature) != string(signature) {
+				t.Errorf("signature = %x, want %x", gotSignature, signature)
+			}
+		})
+	}
+}